@@ -0,0 +1,433 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+)
+
+const (
+	// kinesisMaxRecordsCount is the maximum number of records permitted
+	// within a single Firehose PutRecordBatch request.
+	kinesisMaxRecordsCount = 500
+
+	// firehoseDefaultMaxBytesPerRequest is Firehose's documented limit on the
+	// total size of a PutRecordBatch request.
+	firehoseDefaultMaxBytesPerRequest = 4 * 1024 * 1024
+
+	// firehoseDefaultMaxBytesPerRecord is Firehose's documented limit on the
+	// size of a single record.
+	firehoseDefaultMaxBytesPerRecord = 1024 * 1024
+)
+
+// recordEncodedSize returns the size a record's data will occupy once
+// Firehose base64-encodes it, which is what counts against the
+// PutRecordBatch request size limit.
+func recordEncodedSize(data []byte) int {
+	return base64.StdEncoding.EncodedLen(len(data))
+}
+
+func kinesisFirehoseOutputConfig() *service.ConfigSpec {
+	return service.NewConfigSpec().
+		Categories("Services", "AWS").
+		Summary("Sends messages to a Kinesis Firehose delivery stream.").
+		Fields(
+			service.NewStringField("stream").
+				Description("The stream to publish messages to."),
+			service.NewStringField("region").
+				Description("The AWS region to target.").
+				Default(""),
+			service.NewStringField("endpoint").
+				Description("Allows you to specify a custom endpoint for the AWS API.").
+				Default("").
+				Advanced(),
+			service.NewStringField("credentials_profile").
+				Description("The AWS credentials profile to use, if empty the default profile is used.").
+				Default("").
+				Advanced(),
+			service.NewIntField("max_bytes_per_request").
+				Description("The maximum total size, in bytes, of the records sent in a single PutRecordBatch request, accounting for the base64 overhead Firehose applies. This should not exceed Firehose's own 4 MiB request limit.").
+				Default(firehoseDefaultMaxBytesPerRequest).
+				Advanced(),
+			service.NewIntField("max_bytes_per_record").
+				Description("The maximum size, in bytes, of an individual message. Messages over this size are rejected without being retried, as splitting a batch further cannot make them fit. This should not exceed Firehose's own 1 MiB per-record limit.").
+				Default(firehoseDefaultMaxBytesPerRecord).
+				Advanced(),
+			service.NewIntField("max_retries").
+				Description("The maximum number of times to retry a record that Firehose reports as failed with a retryable error code before giving up on it. If `error_output` is set the record is routed there once retries are exhausted, otherwise the whole batch is nacked. Records failing with a non-retryable error code are not retried.").
+				Default(3).
+				Advanced(),
+			service.NewOutputField("error_output").
+				Description("An optional fallback output, used instead of nacking the whole batch, that receives records still failing with a retryable error code after `max_retries` attempts, records Firehose rejects with a non-retryable error code (on the first attempt), and messages larger than `max_bytes_per_record` (before any request is made). Routed messages are annotated with `firehose_error_code`, `firehose_error_message` and `firehose_stream` metadata.").
+				Optional(),
+			service.NewOutputMaxInFlightField(),
+			service.NewBackOffField("backoff", false, nil),
+		)
+}
+
+func init() {
+	err := service.RegisterBatchOutput("aws_kinesis_firehose", kinesisFirehoseOutputConfig(),
+		func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+			if maxInFlight, err = conf.FieldMaxInFlight(); err != nil {
+				return
+			}
+
+			var kConf kfoConfig
+			if kConf, err = kfoConfigFromParsed(conf); err != nil {
+				return
+			}
+
+			var errOut *service.OwnedOutput
+			if conf.Contains("error_output") {
+				if errOut, err = conf.FieldOutput("error_output"); err != nil {
+					return
+				}
+			}
+
+			out, err = newKinesisFirehoseWriter(kConf, errOut, mgr)
+			return
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// kfoConfig holds the fully resolved configuration for a kinesisFirehoseWriter.
+type kfoConfig struct {
+	Stream string
+
+	MaxBytesPerRequest int
+	MaxBytesPerRecord  int
+
+	aconf aws.Config
+
+	backoffCtor func() backoff.BackOff
+}
+
+func kfoConfigFromParsed(conf *service.ParsedConfig) (kConf kfoConfig, err error) {
+	if kConf.Stream, err = conf.FieldString("stream"); err != nil {
+		return
+	}
+	if kConf.MaxBytesPerRequest, err = conf.FieldInt("max_bytes_per_request"); err != nil {
+		return
+	}
+	if kConf.MaxBytesPerRecord, err = conf.FieldInt("max_bytes_per_record"); err != nil {
+		return
+	}
+
+	var maxRetries int
+	if maxRetries, err = conf.FieldInt("max_retries"); err != nil {
+		return
+	}
+
+	var boffCtor func() backoff.BackOff
+	if boffCtor, err = conf.FieldBackOff("backoff"); err != nil {
+		return
+	}
+	kConf.backoffCtor = func() backoff.BackOff {
+		return backoff.WithMaxRetries(boffCtor(), uint64(maxRetries))
+	}
+
+	var region, endpoint, profile string
+	if region, err = conf.FieldString("region"); err != nil {
+		return
+	}
+	if endpoint, err = conf.FieldString("endpoint"); err != nil {
+		return
+	}
+	if profile, err = conf.FieldString("credentials_profile"); err != nil {
+		return
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	if profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(profile))
+	}
+
+	if kConf.aconf, err = awsconfig.LoadDefaultConfig(context.Background(), opts...); err != nil {
+		return
+	}
+	if endpoint != "" {
+		kConf.aconf.BaseEndpoint = aws.String(endpoint)
+	}
+	return
+}
+
+// firehoseAPI is the subset of the Firehose v2 client used by
+// kinesisFirehoseWriter, allowing tests to provide a mock implementation.
+type firehoseAPI interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+// errorOutputWriter is the minimal surface kinesisFirehoseWriter needs from
+// an optional fallback output, allowing tests to substitute a mock.
+type errorOutputWriter interface {
+	WriteBatch(ctx context.Context, batch service.MessageBatch) error
+}
+
+type kinesisFirehoseWriter struct {
+	conf        kfoConfig
+	firehose    firehoseAPI
+	errorOutput errorOutputWriter
+	log         *service.Logger
+}
+
+func newKinesisFirehoseWriter(conf kfoConfig, errorOutput *service.OwnedOutput, mgr *service.Resources) (*kinesisFirehoseWriter, error) {
+	w := &kinesisFirehoseWriter{
+		conf:     conf,
+		firehose: firehose.NewFromConfig(conf.aconf),
+		log:      mgr.Logger(),
+	}
+	if errorOutput != nil {
+		w.errorOutput = errorOutput
+	}
+	return w, nil
+}
+
+func (a *kinesisFirehoseWriter) Connect(ctx context.Context) error {
+	return nil
+}
+
+// kfoEntry pairs a Firehose record with the original message it was built
+// from, so that a record failing permanently can still be routed to
+// error_output with its original contents and metadata intact.
+type kfoEntry struct {
+	msg *service.Message
+	rec types.Record
+}
+
+func (a *kinesisFirehoseWriter) toEntries(batch service.MessageBatch) ([]kfoEntry, error) {
+	entries := make([]kfoEntry, len(batch))
+	for i, part := range batch {
+		data, err := part.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = kfoEntry{msg: part, rec: types.Record{Data: data}}
+	}
+	return entries, nil
+}
+
+// errRecordTooLarge is returned when a single message exceeds the configured
+// max_bytes_per_record limit. Splitting the batch further cannot make the
+// record fit, so the writer surfaces this immediately instead of spending
+// its retry budget on it.
+type errRecordTooLarge struct {
+	index int
+	size  int
+	limit int
+}
+
+func (e *errRecordTooLarge) Error() string {
+	return fmt.Sprintf("message %d has size %d bytes, which exceeds the configured max_bytes_per_record of %d bytes", e.index, e.size, e.limit)
+}
+
+// nextChunk splits off a prefix of remaining that fits within both the
+// Firehose record-count limit and the configured max_bytes_per_request,
+// accounting for the base64 overhead Firehose applies to each record.
+func (a *kinesisFirehoseWriter) nextChunk(remaining []kfoEntry) (chunk, rest []kfoEntry) {
+	var size int
+	for i, e := range remaining {
+		if i >= kinesisMaxRecordsCount {
+			break
+		}
+		recSize := recordEncodedSize(e.rec.Data)
+		if i > 0 && size+recSize > a.conf.MaxBytesPerRequest {
+			break
+		}
+		size += recSize
+		chunk = remaining[:i+1]
+	}
+	return chunk, remaining[len(chunk):]
+}
+
+// kfoFailure is a record Firehose reported as failed, together with the
+// error details it returned for it.
+type kfoFailure struct {
+	entry   kfoEntry
+	code    string
+	message string
+}
+
+// firehoseRetryableErrorCodes are the PutRecordBatch per-record error codes
+// that represent transient, throttling-style conditions worth retrying.
+// Any other code (bad schema, oversized field, etc.) is permanent and is
+// routed to error_output immediately rather than spending the shared
+// retry budget on it.
+var firehoseRetryableErrorCodes = map[string]bool{
+	"ServiceUnavailableException":            true,
+	"ProvisionedThroughputExceededException": true,
+	"InternalFailure":                        true,
+}
+
+func isRetryableFirehoseError(code string) bool {
+	return firehoseRetryableErrorCodes[code]
+}
+
+// sendToErrorOutput forwards permanently-failed records to the configured
+// fallback output, annotated with details of why Firehose rejected them.
+func (a *kinesisFirehoseWriter) sendToErrorOutput(ctx context.Context, failures []kfoFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	dlqBatch := make(service.MessageBatch, len(failures))
+	for i, f := range failures {
+		msg := f.entry.msg.Copy()
+		msg.MetaSetMut("firehose_error_code", f.code)
+		msg.MetaSetMut("firehose_error_message", f.message)
+		msg.MetaSetMut("firehose_stream", a.conf.Stream)
+		dlqBatch[i] = msg
+	}
+	return a.errorOutput.WriteBatch(ctx, dlqBatch)
+}
+
+func (a *kinesisFirehoseWriter) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	entries, err := a.toEntries(batch)
+	if err != nil {
+		return err
+	}
+
+	// Oversized records can never succeed no matter how the batch is
+	// chunked, so they're pulled out up front. With error_output configured
+	// they're forwarded there and the rest of the batch is still written;
+	// without it the whole batch is nacked, as there's nowhere else to put
+	// the bad record.
+	remaining := make([]kfoEntry, 0, len(entries))
+	var oversized []kfoFailure
+	for i, e := range entries {
+		size := len(e.rec.Data)
+		if size <= a.conf.MaxBytesPerRecord {
+			remaining = append(remaining, e)
+			continue
+		}
+		tooLargeErr := &errRecordTooLarge{index: i, size: size, limit: a.conf.MaxBytesPerRecord}
+		if a.errorOutput == nil {
+			return tooLargeErr
+		}
+		oversized = append(oversized, kfoFailure{entry: e, code: "MessageTooLarge", message: tooLargeErr.Error()})
+	}
+
+	if len(oversized) > 0 {
+		if err := a.sendToErrorOutput(ctx, oversized); err != nil {
+			return err
+		}
+	}
+
+	boff := a.conf.backoffCtor()
+
+	for len(remaining) > 0 {
+		chunk, rest := a.nextChunk(remaining)
+
+		records := make([]types.Record, len(chunk))
+		for i, e := range chunk {
+			records[i] = e.rec
+		}
+
+		res, err := a.firehose.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: &a.conf.Stream,
+			Records:            records,
+		})
+		if err != nil {
+			a.log.Errorf("Firehose error: %v\n", err)
+			wait := boff.NextBackOff()
+			if wait == backoff.Stop {
+				return err
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		failedCount := aws.ToInt64(res.FailedPutCount)
+		if failedCount == 0 {
+			boff.Reset()
+			remaining = rest
+			continue
+		}
+
+		var transient, permanent []kfoFailure
+		for i, entry := range res.RequestResponses {
+			if entry.ErrorCode == nil {
+				continue
+			}
+			f := kfoFailure{
+				entry:   chunk[i],
+				code:    aws.ToString(entry.ErrorCode),
+				message: aws.ToString(entry.ErrorMessage),
+			}
+			if isRetryableFirehoseError(f.code) {
+				transient = append(transient, f)
+			} else {
+				permanent = append(permanent, f)
+			}
+		}
+
+		a.log.Errorf("Firehose PutRecordBatch failed to put %d records (%d transient, %d permanent)\n", failedCount, len(transient), len(permanent))
+
+		// Permanent failures can never succeed no matter how many times the
+		// chunk is retried, so they're forwarded on this very attempt rather
+		// than waiting for the shared backoff to exhaust.
+		if len(permanent) > 0 {
+			if a.errorOutput == nil {
+				return fmt.Errorf("failed to put %d records with non-retryable errors", len(permanent))
+			}
+			if err := a.sendToErrorOutput(ctx, permanent); err != nil {
+				return err
+			}
+		}
+
+		if len(transient) == 0 {
+			boff.Reset()
+			remaining = rest
+			continue
+		}
+
+		wait := boff.NextBackOff()
+		if wait == backoff.Stop {
+			if a.errorOutput == nil {
+				return fmt.Errorf("failed to put %d records after exhausting retries", len(transient))
+			}
+			if err := a.sendToErrorOutput(ctx, transient); err != nil {
+				return err
+			}
+			boff.Reset()
+			remaining = rest
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		failed := make([]kfoEntry, len(transient))
+		for i, f := range transient {
+			failed[i] = f.entry
+		}
+		remaining = append(failed, rest...)
+	}
+
+	return nil
+}
+
+func (a *kinesisFirehoseWriter) Close(ctx context.Context) error {
+	if closer, ok := a.errorOutput.(interface{ Close(context.Context) error }); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
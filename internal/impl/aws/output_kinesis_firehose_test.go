@@ -4,12 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/stretchr/testify/require"
 
@@ -21,7 +21,7 @@ type mockKinesisFirehose struct {
 	fn func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
 }
 
-func (m *mockKinesisFirehose) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+func (m *mockKinesisFirehose) PutRecordBatch(ctx context.Context, input *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
 	return m.fn(input)
 }
 
@@ -30,17 +30,19 @@ func testKFO(t *testing.T, m *mockKinesisFirehose) *kinesisFirehoseWriter {
 
 	return &kinesisFirehoseWriter{
 		conf: kfoConfig{
-			Stream: "foo",
+			Stream:             "foo",
+			MaxBytesPerRequest: firehoseDefaultMaxBytesPerRequest,
+			MaxBytesPerRecord:  firehoseDefaultMaxBytesPerRecord,
 			backoffCtor: func() backoff.BackOff {
 				return backoff.NewExponentialBackOff()
 			},
-			session: session.Must(session.NewSession(&aws.Config{
-				Credentials: credentials.NewStaticCredentials("xxxxx", "xxxxx", "xxxxx"),
-			})),
+			aconf: aws.Config{
+				Region: "eu-west-1",
+			},
 		},
 		firehose: m,
+		log:      service.MockResources().Logger(),
 	}
-
 }
 
 func TestKinesisFirehoseWriteSinglePartMessage(t *testing.T) {
@@ -133,18 +135,18 @@ func TestKinesisFirehoseWriteChunkWithThrottling(t *testing.T) {
 				batchLengths = append(batchLengths, count)
 				var failed int64
 				output := firehose.PutRecordBatchOutput{
-					RequestResponses: make([]*firehose.PutRecordBatchResponseEntry, count),
+					RequestResponses: make([]types.PutRecordBatchResponseEntry, count),
 				}
 				for i := 0; i < count; i++ {
-					var entry firehose.PutRecordBatchResponseEntry
+					var entry types.PutRecordBatchResponseEntry
 					if i >= 300 {
 						failed++
-						entry.SetErrorCode(firehose.ErrCodeServiceUnavailableException)
-						entry.SetErrorMessage("Mocked ProvisionedThroughputExceededException")
+						entry.ErrorCode = aws.String(string(types.ErrorCodeServiceUnavailableException))
+						entry.ErrorMessage = aws.String("Mocked ProvisionedThroughputExceededException")
 					}
-					output.RequestResponses[i] = &entry
+					output.RequestResponses[i] = entry
 				}
-				output.SetFailedPutCount(failed)
+				output.FailedPutCount = aws.Int64(failed)
 				return &output, nil
 			},
 		},
@@ -197,31 +199,31 @@ func TestKinesisFirehoseWriteError(t *testing.T) {
 		t.Errorf("Expected err to equal %s, got %v", exp, err)
 	}
 	if exp, act := 3, calls; act != exp {
-		t.Errorf("Expected firehose PutRecordbatch to have call count %d, got %d", exp, act)
+		t.Errorf("Expected firehose PutRecordbatch to have call count %d, got %d", exp, calls)
 	}
 }
 
 func TestKinesisFirehoseWriteMessageThrottling(t *testing.T) {
 	t.Parallel()
-	var calls [][]*firehose.Record
+	var calls [][]types.Record
 
 	k := testKFO(t,
 		&mockKinesisFirehose{
 			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
-				records := make([]*firehose.Record, len(input.Records))
+				records := make([]types.Record, len(input.Records))
 				copy(records, input.Records)
 				calls = append(calls, records)
 				var failed int64
 				var output firehose.PutRecordBatchOutput
 				for i := 0; i < len(input.Records); i++ {
-					entry := firehose.PutRecordBatchResponseEntry{}
+					entry := types.PutRecordBatchResponseEntry{}
 					if i > 0 {
 						failed++
-						entry.SetErrorCode(firehose.ErrCodeServiceUnavailableException)
+						entry.ErrorCode = aws.String(string(types.ErrorCodeServiceUnavailableException))
 					}
-					output.RequestResponses = append(output.RequestResponses, &entry)
+					output.RequestResponses = append(output.RequestResponses, entry)
 				}
-				output.SetFailedPutCount(failed)
+				output.FailedPutCount = aws.Int64(failed)
 				return &output, nil
 			},
 		},
@@ -246,6 +248,208 @@ func TestKinesisFirehoseWriteMessageThrottling(t *testing.T) {
 	}
 }
 
+func TestKinesisFirehoseWriteChunkByBytes(t *testing.T) {
+	t.Parallel()
+	batchLengths := []int{}
+
+	k := testKFO(t,
+		&mockKinesisFirehose{
+			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+				batchLengths = append(batchLengths, len(input.Records))
+				return &firehose.PutRecordBatchOutput{}, nil
+			},
+		},
+	)
+	// Each record is 300 bytes, encoding to 400 bytes, so a 1000 byte request
+	// limit should only fit two records per call.
+	k.conf.MaxBytesPerRequest = 1000
+
+	msg := service.MessageBatch{}
+	for i := 0; i < 5; i++ {
+		msg = append(msg, service.NewMessage(make([]byte, 300)))
+	}
+
+	require.NoError(t, k.WriteBatch(context.Background(), msg))
+
+	expectedLengths := []int{2, 2, 1}
+	if exp, act := len(expectedLengths), len(batchLengths); act != exp {
+		t.Fatalf("Expected kinesis firehose PutRecordBatch to have call count %d, got %d", exp, act)
+	}
+	for i, act := range batchLengths {
+		if exp := expectedLengths[i]; act != exp {
+			t.Errorf("Expected kinesis firehose PutRecordBatch call %d to have batch size %d, got %d", i, exp, act)
+		}
+	}
+}
+
+func TestKinesisFirehoseWriteRecordTooLarge(t *testing.T) {
+	t.Parallel()
+	var calls int
+
+	k := testKFO(t,
+		&mockKinesisFirehose{
+			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+				calls++
+				return &firehose.PutRecordBatchOutput{}, nil
+			},
+		},
+	)
+	k.conf.MaxBytesPerRecord = 100
+
+	msg := service.MessageBatch{
+		service.NewMessage(make([]byte, 50)),
+		service.NewMessage(make([]byte, 200)),
+	}
+
+	err := k.WriteBatch(context.Background(), msg)
+	require.Error(t, err)
+	if exp, act := 0, calls; act != exp {
+		t.Errorf("Expected oversized message to be rejected before any PutRecordBatch call, got %d calls", act)
+	}
+}
+
+type mockErrorOutput struct {
+	batches []service.MessageBatch
+}
+
+func (m *mockErrorOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	m.batches = append(m.batches, batch)
+	return nil
+}
+
+func TestKinesisFirehoseWriteErrorOutput(t *testing.T) {
+	t.Parallel()
+	var calls int
+
+	errOut := &mockErrorOutput{}
+
+	k := testKFO(t,
+		&mockKinesisFirehose{
+			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+				calls++
+				count := len(input.Records)
+				output := firehose.PutRecordBatchOutput{
+					RequestResponses: make([]types.PutRecordBatchResponseEntry, count),
+				}
+				var failed int64
+				for i, rec := range input.Records {
+					data := string(rec.Data)
+					switch {
+					case strings.Contains(data, `"permanent":true`):
+						// A non-retryable error code: should be forwarded to
+						// error_output on this very attempt.
+						failed++
+						output.RequestResponses[i] = types.PutRecordBatchResponseEntry{
+							ErrorCode:    aws.String("InvalidArgumentException"),
+							ErrorMessage: aws.String("Mocked non-retryable error"),
+						}
+					case strings.Contains(data, `"transient":true`) && calls == 1:
+						// A transient, throttling-style error code that only
+						// fails on the first attempt and succeeds on retry.
+						failed++
+						output.RequestResponses[i] = types.PutRecordBatchResponseEntry{
+							ErrorCode:    aws.String("ServiceUnavailableException"),
+							ErrorMessage: aws.String("Mocked throttling"),
+						}
+					}
+				}
+				output.FailedPutCount = aws.Int64(failed)
+				return &output, nil
+			},
+		},
+	)
+	k.conf.backoffCtor = func() backoff.BackOff {
+		return backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 2)
+	}
+	k.errorOutput = errOut
+
+	msg := service.MessageBatch{
+		service.NewMessage([]byte(`{"foo":"bar","id":1,"transient":true}`)),
+		service.NewMessage([]byte(`{"foo":"bar","id":2,"permanent":true}`)),
+	}
+
+	require.NoError(t, k.WriteBatch(context.Background(), msg))
+
+	// The permanent failure is forwarded on the first attempt, and the
+	// transient one succeeds on the second, so no retries are exhausted.
+	if exp, act := 2, calls; act != exp {
+		t.Errorf("Expected firehose PutRecordBatch to have call count %d, got %d", exp, act)
+	}
+
+	if exp, act := 1, len(errOut.batches); act != exp {
+		t.Fatalf("Expected error output to receive %d batches, got %d", exp, act)
+	}
+	dlq := errOut.batches[0]
+	if exp, act := 1, len(dlq); act != exp {
+		t.Fatalf("Expected error output batch to have %d messages, got %d", exp, act)
+	}
+
+	dlqMsg := dlq[0]
+	dlqData, err := dlqMsg.AsBytes()
+	require.NoError(t, err)
+	if !strings.Contains(string(dlqData), `"permanent":true`) {
+		t.Errorf("Expected only the permanently-failed record to reach error_output, got %q", dlqData)
+	}
+	code, _ := dlqMsg.MetaGet("firehose_error_code")
+	if exp, act := "InvalidArgumentException", code; act != exp {
+		t.Errorf("Expected firehose_error_code metadata %q, got %q", exp, act)
+	}
+	stream, _ := dlqMsg.MetaGet("firehose_stream")
+	if exp, act := "foo", stream; act != exp {
+		t.Errorf("Expected firehose_stream metadata %q, got %q", exp, act)
+	}
+}
+
+func TestKinesisFirehoseWriteRecordTooLargeWithErrorOutput(t *testing.T) {
+	t.Parallel()
+	var calls int
+
+	errOut := &mockErrorOutput{}
+
+	k := testKFO(t,
+		&mockKinesisFirehose{
+			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+				calls++
+				if exp, act := 1, len(input.Records); exp != act {
+					return nil, fmt.Errorf("expected input to have records with length %d, got %d", exp, act)
+				}
+				return &firehose.PutRecordBatchOutput{}, nil
+			},
+		},
+	)
+	k.conf.MaxBytesPerRecord = 100
+	k.errorOutput = errOut
+
+	msg := service.MessageBatch{
+		service.NewMessage(make([]byte, 50)),
+		service.NewMessage(make([]byte, 200)),
+	}
+
+	// With error_output configured the oversized record is routed there and
+	// the rest of the batch is still written, rather than nacking everything.
+	require.NoError(t, k.WriteBatch(context.Background(), msg))
+	if exp, act := 1, calls; act != exp {
+		t.Errorf("Expected the valid record to still be sent to Firehose, got %d calls", act)
+	}
+
+	if exp, act := 1, len(errOut.batches); act != exp {
+		t.Fatalf("Expected error output to receive %d batches, got %d", exp, act)
+	}
+	dlq := errOut.batches[0]
+	if exp, act := 1, len(dlq); act != exp {
+		t.Fatalf("Expected error output batch to have %d messages, got %d", exp, act)
+	}
+	dlqData, err := dlq[0].AsBytes()
+	require.NoError(t, err)
+	if exp, act := 200, len(dlqData); act != exp {
+		t.Errorf("Expected the oversized record to be routed to error_output, got %d bytes", act)
+	}
+	code, _ := dlq[0].MetaGet("firehose_error_code")
+	if exp, act := "MessageTooLarge", code; act != exp {
+		t.Errorf("Expected firehose_error_code metadata %q, got %q", exp, act)
+	}
+}
+
 func TestKinesisFirehoseWriteBackoffMaxRetriesExceeded(t *testing.T) {
 	t.Parallel()
 	var calls int
@@ -255,9 +459,9 @@ func TestKinesisFirehoseWriteBackoffMaxRetriesExceeded(t *testing.T) {
 			fn: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
 				calls++
 				var output firehose.PutRecordBatchOutput
-				output.SetFailedPutCount(int64(1))
-				output.RequestResponses = append(output.RequestResponses, &firehose.PutRecordBatchResponseEntry{
-					ErrorCode: aws.String(firehose.ErrCodeServiceUnavailableException),
+				output.FailedPutCount = aws.Int64(1)
+				output.RequestResponses = append(output.RequestResponses, types.PutRecordBatchResponseEntry{
+					ErrorCode: aws.String(string(types.ErrorCodeServiceUnavailableException)),
 				})
 				return &output, nil
 			},